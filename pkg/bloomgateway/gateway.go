@@ -0,0 +1,117 @@
+package bloomgateway
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/loki/pkg/bloomgateway/plan"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/bloomshipper"
+)
+
+// NewPlanner builds the plan.Builder shared by every worker of a gateway.
+// The builder holds no state of its own - sharing one instance across
+// workers simply avoids registering its metrics more than once.
+func NewPlanner(shipper bloomshipper.Interface, registerer prometheus.Registerer, namespace, subsystem string) *plan.Builder[Task] {
+	metrics := plan.NewMetrics(registerer, namespace, subsystem)
+	bounds := func(t Task) plan.Bounds {
+		from, through := t.Bounds()
+		return plan.Bounds{From: from, Through: through}
+	}
+	return plan.NewBuilder[Task](Day, bounds, shipper.GetBlockRefs, partitionTasks, metrics)
+}
+
+// drainer is the subset of *worker that Gateway depends on for draining.
+// Depending on this instead of *worker directly lets Gateway be exercised
+// with fakes in tests, without standing up a real queue.RequestQueue and
+// bloomshipper.Interface for every worker.
+type drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// Gateway owns the set of workers that consume tasks from the bloom query
+// queue on behalf of the bloom gateway service.
+type Gateway struct {
+	workers      []drainer
+	tenantQueues *TenantQueues
+	logger       *slog.Logger
+}
+
+// NewGateway builds a Gateway over workers, sharing the same tenantQueues
+// the workers themselves were constructed with so that Drain can fail any
+// task left in a per-tenant pending queue (see TenantQueues.Defer) once
+// shutdown begins.
+func NewGateway(workers []*worker, tenantQueues *TenantQueues, logger *slog.Logger) *Gateway {
+	drainers := make([]drainer, len(workers))
+	for i, w := range workers {
+		drainers[i] = w
+	}
+	return &Gateway{
+		workers:      drainers,
+		tenantQueues: tenantQueues,
+		logger:       logger,
+	}
+}
+
+// RegisterAdminRoutes wires DrainHandler up on mux, next to the other admin
+// endpoints, so it can be set as a Kubernetes preStop hook ahead of a
+// rolling restart.
+func (g *Gateway) RegisterAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/bloomgateway/drain", g.DrainHandler)
+}
+
+// Drain gracefully stops every worker: it unregisters each one from the
+// queue so no new batches are dequeued, then waits for whatever batch is
+// currently in flight to finish, up to the deadline carried by ctx. Once
+// every worker has drained, any task still sitting in a per-tenant pending
+// queue (deferred because its tenant was over the in-flight cap and never
+// promoted) is failed too, rather than left to hang until the caller's own
+// deadline. It is meant to be called from a Kubernetes preStop hook ahead
+// of a rolling restart so that outstanding filter queries are completed
+// rather than dropped, forcing clients to retry.
+func (g *Gateway) Drain(ctx context.Context) error {
+	g.logger.Info("draining bloom gateway", "workers", len(g.workers))
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(g.workers))
+	for i, w := range g.workers {
+		i, w := i, w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = w.Drain(ctx)
+		}()
+	}
+	wg.Wait()
+
+	g.tenantQueues.FailPending(errors.New("bloom gateway is draining"))
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DrainHandler exposes Drain over the admin HTTP surface so it can be wired
+// up next to the other lifecycler endpoints, e.g. as a preStop hook.
+func (g *Gateway) DrainHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+	}
+
+	if err := g.Drain(ctx); err != nil {
+		http.Error(w, errors.Wrap(err, "draining bloom gateway").Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,126 @@
+package bloomgateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeDrainer is a drainer that records whether it was asked to drain and
+// returns a canned error, so Gateway.Drain/DrainHandler can be tested
+// without a real worker and its queue.RequestQueue/bloomshipper.Interface
+// dependencies.
+type fakeDrainer struct {
+	drained bool
+	err     error
+}
+
+func (f *fakeDrainer) Drain(context.Context) error {
+	f.drained = true
+	return f.err
+}
+
+func newTestGateway(t *testing.T, drainers ...*fakeDrainer) *Gateway {
+	t.Helper()
+	asDrainers := make([]drainer, len(drainers))
+	for i, d := range drainers {
+		asDrainers[i] = d
+	}
+	return &Gateway{
+		workers:      asDrainers,
+		tenantQueues: NewTenantQueues(0, prometheus.NewPedanticRegistry(), "loki", "bloomgateway"),
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestGateway_DrainStopsEveryWorker(t *testing.T) {
+	a, b := &fakeDrainer{}, &fakeDrainer{}
+	g := newTestGateway(t, a, b)
+
+	if err := g.Drain(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !a.drained || !b.drained {
+		t.Fatalf("expected every worker to be drained, got a=%v b=%v", a.drained, b.drained)
+	}
+}
+
+func TestGateway_DrainReturnsFirstWorkerError(t *testing.T) {
+	failure := errors.New("worker failed to drain")
+	a, b := &fakeDrainer{}, &fakeDrainer{err: failure}
+	g := newTestGateway(t, a, b)
+
+	err := g.Drain(context.Background())
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected drain to surface the worker's error, got %v", err)
+	}
+	// A failure in one worker must not stop Drain from still draining the rest.
+	if !a.drained {
+		t.Fatal("expected the other worker to still be drained")
+	}
+}
+
+func TestGateway_DrainFailsPendingTasks(t *testing.T) {
+	g := newTestGateway(t, &fakeDrainer{})
+
+	task := newTestTask(context.Background(), "tenant-a", "deferred-task")
+	g.tenantQueues.Defer(task)
+
+	if err := g.Drain(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	select {
+	case err := <-task.ErrCh:
+		if err == nil {
+			t.Fatal("expected the pending task to fail with a non-nil error")
+		}
+	default:
+		t.Fatal("expected the pending task to receive an error once the gateway drained")
+	}
+}
+
+func TestGateway_DrainHandlerServesOKOnSuccess(t *testing.T) {
+	g := newTestGateway(t, &fakeDrainer{})
+
+	req := httptest.NewRequest(http.MethodPost, "/bloomgateway/drain", nil)
+	rec := httptest.NewRecorder()
+	g.DrainHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestGateway_DrainHandlerServesErrorOnFailure(t *testing.T) {
+	g := newTestGateway(t, &fakeDrainer{err: errors.New("boom")})
+
+	req := httptest.NewRequest(http.MethodPost, "/bloomgateway/drain", nil)
+	rec := httptest.NewRecorder()
+	g.DrainHandler(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+}
+
+func TestGateway_RegisterAdminRoutesWiresDrainHandler(t *testing.T) {
+	g := newTestGateway(t, &fakeDrainer{})
+
+	mux := http.NewServeMux()
+	g.RegisterAdminRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodPost, "/bloomgateway/drain", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the registered route to reach DrainHandler and return %d, got %d", http.StatusOK, rec.Code)
+	}
+}
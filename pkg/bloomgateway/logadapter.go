@@ -0,0 +1,63 @@
+package bloomgateway
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// slogToGoKit bridges an *slog.Logger to the go-kit log.Logger interface
+// still expected by some dskit components (e.g. services.Service
+// implementations and the lifecycler) that haven't migrated off go-kit yet.
+// Log levels are mapped from go-kit's "level" key so records keep landing at
+// the right slog level instead of all coming through as Info.
+type slogToGoKit struct {
+	logger *slog.Logger
+}
+
+// newGoKitLogger wraps logger so it can be passed to dskit APIs that require
+// a github.com/go-kit/log.Logger, without losing structured attributes
+// already attached to logger via .With. newWorker uses this to report
+// services.Service Failed transitions through the same logger as the rest
+// of the worker's logging.
+func newGoKitLogger(logger *slog.Logger) log.Logger {
+	return &slogToGoKit{logger: logger}
+}
+
+func (a *slogToGoKit) Log(keyvals ...interface{}) error {
+	lvl := slog.LevelInfo
+	attrs := make([]interface{}, 0, len(keyvals)+1)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 >= len(keyvals) {
+			// Odd number of keyvals: go-kit itself pads the missing value
+			// with "(MISSING)" rather than dropping the trailing key, so a
+			// caller that forgot to pair up an argument still sees it logged.
+			attrs = append(attrs, keyvals[i], "(MISSING)")
+			break
+		}
+		if keyvals[i] == level.Key() {
+			lvl = goKitToSlogLevel(keyvals[i+1])
+			continue
+		}
+		attrs = append(attrs, keyvals[i], keyvals[i+1])
+	}
+
+	a.logger.Log(context.Background(), lvl, "", attrs...)
+	return nil
+}
+
+func goKitToSlogLevel(v interface{}) slog.Level {
+	switch v {
+	case level.DebugValue():
+		return slog.LevelDebug
+	case level.WarnValue():
+		return slog.LevelWarn
+	case level.ErrorValue():
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
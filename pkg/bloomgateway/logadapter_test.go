@@ -0,0 +1,100 @@
+package bloomgateway
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// capturingHandler records the level and attributes of the last handled record.
+type capturingHandler struct {
+	lastLevel slog.Level
+	lastAttrs []slog.Attr
+}
+
+func (h *capturingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *capturingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.lastLevel = r.Level
+	h.lastAttrs = nil
+	r.Attrs(func(a slog.Attr) bool {
+		h.lastAttrs = append(h.lastAttrs, a)
+		return true
+	})
+	return nil
+}
+func (h *capturingHandler) WithAttrs(_ []slog.Attr) slog.Handler { return h }
+func (h *capturingHandler) WithGroup(_ string) slog.Handler      { return h }
+
+func TestSlogToGoKit_MapsLevels(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		logFunc  func(l log.Logger)
+		expected slog.Level
+	}{
+		{
+			name: "debug",
+			logFunc: func(l log.Logger) {
+				level.Debug(l).Log("msg", "hi")
+			},
+			expected: slog.LevelDebug,
+		},
+		{
+			name: "warn",
+			logFunc: func(l log.Logger) {
+				level.Warn(l).Log("msg", "hi")
+			},
+			expected: slog.LevelWarn,
+		},
+		{
+			name: "error",
+			logFunc: func(l log.Logger) {
+				level.Error(l).Log("msg", "hi")
+			},
+			expected: slog.LevelError,
+		},
+		{
+			name: "info",
+			logFunc: func(l log.Logger) {
+				level.Info(l).Log("msg", "hi")
+			},
+			expected: slog.LevelInfo,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &capturingHandler{}
+			adapter := newGoKitLogger(slog.New(h))
+			tc.logFunc(adapter)
+			if h.lastLevel != tc.expected {
+				t.Fatalf("expected level %v, got %v", tc.expected, h.lastLevel)
+			}
+		})
+	}
+}
+
+// TestSlogToGoKit_PadsTrailingUnpairedKey mirrors go-kit's own log.Logger
+// behavior: a caller that passes an odd number of keyvals gets its trailing
+// key logged with a "(MISSING)" value instead of silently dropped.
+func TestSlogToGoKit_PadsTrailingUnpairedKey(t *testing.T) {
+	h := &capturingHandler{}
+	adapter := newGoKitLogger(slog.New(h))
+
+	if err := adapter.Log("msg", "hi", "incomplete"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var gotIncomplete bool
+	for _, a := range h.lastAttrs {
+		if a.Key == "incomplete" {
+			gotIncomplete = true
+			if a.Value.String() != "(MISSING)" {
+				t.Fatalf("expected trailing unpaired key to be padded with (MISSING), got %q", a.Value.String())
+			}
+		}
+	}
+	if !gotIncomplete {
+		t.Fatalf("expected the trailing unpaired key to still be logged, got attrs %v", h.lastAttrs)
+	}
+}
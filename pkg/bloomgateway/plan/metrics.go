@@ -0,0 +1,37 @@
+package plan
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics holds the planner's instrumentation.
+type Metrics struct {
+	unitsTotal     prometheus.Counter
+	coalescedTasks prometheus.Counter
+	buildDuration  prometheus.Histogram
+}
+
+// NewMetrics registers and returns the planner metrics.
+func NewMetrics(registerer prometheus.Registerer, namespace, subsystem string) *Metrics {
+	return &Metrics{
+		unitsTotal: promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "plan_units_total",
+			Help:      "Total number of execution plan units produced by the planner",
+		}),
+		coalescedTasks: promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "plan_coalesced_tasks_total",
+			Help:      "Total number of tasks that were merged into an already-planned unit instead of creating a new one",
+		}),
+		buildDuration: promauto.With(registerer).NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "plan_build_duration_seconds",
+			Help:      "Time spent building an execution plan for a batch of tasks",
+		}),
+	}
+}
@@ -0,0 +1,181 @@
+// Package plan implements the two-phase request planning for the bloom
+// gateway: given a batch of tasks dequeued by the workers, it builds an
+// ExecutionPlan of units that can be executed directly, without every
+// worker re-deriving per-day/per-block groupings in its own loop. Block
+// references are resolved once per day within a single Build call; they are
+// not shared across calls or across workers.
+package plan
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/bloomshipper"
+)
+
+// Bounds describes the half-open day range [From, Through) a task is
+// interested in.
+type Bounds struct {
+	From, Through time.Time
+}
+
+// GetBlockRefsFunc resolves the blocks that cover a tenant's data from from
+// up to and including through; Builder passes a day's first and last
+// instant. It is typically backed by
+// bloomshipper.Interface.GetBlockRefs.
+type GetBlockRefsFunc func(ctx context.Context, tenant string, from, through model.Time) ([]bloomshipper.BlockRef, error)
+
+// Group is a set of tasks that all overlap the same block.
+type Group[T any] struct {
+	BlockRef bloomshipper.BlockRef
+	Tasks    []T
+}
+
+// PartitionFunc intersects a batch of tasks against the blocks that cover
+// them and returns one group per overlapping block.
+type PartitionFunc[T any] func(tasks []T, blocks []bloomshipper.BlockRef) []Group[T]
+
+// Unit is a single unit of work a worker can execute directly: every task
+// that touches BlockRef on Day, deduplicated across the whole batch that was
+// planned together.
+type Unit[T any] struct {
+	Day      time.Time
+	BlockRef bloomshipper.BlockRef
+	Tasks    []T
+}
+
+// ExecutionPlan is an immutable, ordered set of units. It is an interface so
+// that a future tiered plan can dispatch some units to remote executors
+// instead of having the local worker run all of them.
+type ExecutionPlan[T any] interface {
+	Units() []Unit[T]
+}
+
+type listPlan[T any] struct {
+	units []Unit[T]
+}
+
+func (p *listPlan[T]) Units() []Unit[T] {
+	return p.units
+}
+
+// Builder turns batches of tasks into ExecutionPlans. A Builder holds no
+// mutable state of its own - it is safe for concurrent use, and is meant to
+// be shared across workers simply so its metrics are registered once.
+//
+// Builder does NOT cache GetBlockRefs results across calls to Build, even
+// though two workers (or two consecutive batches on the same worker) can
+// end up resolving blocks for the same tenant/day back-to-back. An earlier
+// version of this Builder did cache across calls, but that cache had no
+// expiry: once a day's blocks were resolved, newly compacted blocks for
+// that day would never be seen again until the gateway restarted, silently
+// returning incomplete results. Scoping the cache to a single Build call
+// (see blockRefCache below) fixes that correctness bug at the cost of the
+// cross-call/cross-worker caching; re-adding it would need an expiry or
+// invalidation strategy, not just a wider-scoped map.
+type Builder[T any] struct {
+	day          time.Duration
+	bounds       func(T) Bounds
+	getBlockRefs GetBlockRefsFunc
+	partition    PartitionFunc[T]
+	metrics      *Metrics
+}
+
+// NewBuilder creates a Builder. day is the bucket size tasks are grouped by
+// (the bloom gateway plans one day at a time), bounds extracts a task's day
+// range, getBlockRefs resolves the blocks for a tenant/day, and partition
+// intersects a set of tasks against those blocks.
+func NewBuilder[T any](day time.Duration, bounds func(T) Bounds, getBlockRefs GetBlockRefsFunc, partition PartitionFunc[T], metrics *Metrics) *Builder[T] {
+	return &Builder[T]{
+		day:          day,
+		bounds:       bounds,
+		getBlockRefs: getBlockRefs,
+		partition:    partition,
+		metrics:      metrics,
+	}
+}
+
+// Build buckets tasks by day, resolves (and caches for the duration of this
+// call) the blocks that cover each day, intersects each day's tasks against
+// those blocks, and merges tasks that land on the same block into a single
+// Unit. All tasks of one call are planned against the blocks of tenant, so
+// only tasks passed to the same call are merged; tasks of different tenants
+// are never merged into one Unit.
+// Tasks whose day has no blocks at all are returned separately in unmatched
+// so the caller can still answer them (with an unfiltered result) without
+// creating a unit.
+func (b *Builder[T]) Build(ctx context.Context, tenant string, tasks []T) (plan ExecutionPlan[T], unmatched []T, err error) {
+	start := time.Now()
+	defer func() { b.metrics.buildDuration.Observe(time.Since(start).Seconds()) }()
+
+	byDay := make(map[time.Time][]T)
+	for _, t := range tasks {
+		bounds := b.bounds(t)
+		if bounds.From.Equal(bounds.Through) {
+			byDay[bounds.From] = append(byDay[bounds.From], t)
+			continue
+		}
+		for d := bounds.From; d.Before(bounds.Through); d = d.Add(b.day) {
+			byDay[d] = append(byDay[d], t)
+		}
+	}
+
+	// blockRefCache memoizes GetBlockRefs within this single Build call only.
+	// Since byDay already holds one entry per day, each day is resolved at
+	// most once per call. It deliberately does not outlive the call: the
+	// compactor keeps writing new blocks for the active day intraday, and a
+	// longer-lived cache would hide them from later queries until the
+	// gateway restarts.
+	blockRefCache := make(map[time.Time][]bloomshipper.BlockRef, len(byDay))
+
+	var units []Unit[T]
+	for day, dayTasks := range byDay {
+		blocks, err := b.blockRefs(ctx, blockRefCache, tenant, day)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(blocks) == 0 {
+			unmatched = append(unmatched, dayTasks...)
+			continue
+		}
+
+		for _, group := range b.partition(dayTasks, blocks) {
+			if i := indexOfUnit(units, day, group.BlockRef); i >= 0 {
+				units[i].Tasks = append(units[i].Tasks, group.Tasks...)
+				b.metrics.coalescedTasks.Add(float64(len(group.Tasks)))
+				continue
+			}
+			units = append(units, Unit[T]{Day: day, BlockRef: group.BlockRef, Tasks: group.Tasks})
+		}
+	}
+
+	b.metrics.unitsTotal.Add(float64(len(units)))
+	return &listPlan[T]{units: units}, unmatched, nil
+}
+
+func indexOfUnit[T any](units []Unit[T], day time.Time, ref bloomshipper.BlockRef) int {
+	for i := range units {
+		if units[i].Day.Equal(day) && units[i].BlockRef == ref {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *Builder[T]) blockRefs(ctx context.Context, cache map[time.Time][]bloomshipper.BlockRef, tenant string, day time.Time) ([]bloomshipper.BlockRef, error) {
+	if cached, ok := cache[day]; ok {
+		return cached, nil
+	}
+
+	from := model.TimeFromUnixNano(day.UnixNano())
+	through := model.TimeFromUnixNano(day.Add(b.day).Add(-1 * time.Nanosecond).UnixNano())
+	blocks, err := b.getBlockRefs(ctx, tenant, from, through)
+	if err != nil {
+		return nil, err
+	}
+
+	cache[day] = blocks
+	return blocks, nil
+}
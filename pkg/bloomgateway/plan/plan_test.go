@@ -0,0 +1,130 @@
+package plan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/storage/stores/shipper/bloomshipper"
+)
+
+type testTask struct {
+	id       string
+	from     time.Time
+	through  time.Time
+	blockRef bloomshipper.BlockRef
+}
+
+func testBounds(t testTask) Bounds {
+	return Bounds{From: t.from, Through: t.through}
+}
+
+func testPartition(tasks []testTask, blocks []bloomshipper.BlockRef) []Group[testTask] {
+	groups := make([]Group[testTask], 0, len(blocks))
+	for _, block := range blocks {
+		var matched []testTask
+		for _, task := range tasks {
+			if task.blockRef == block {
+				matched = append(matched, task)
+			}
+		}
+		if len(matched) > 0 {
+			groups = append(groups, Group[testTask]{BlockRef: block, Tasks: matched})
+		}
+	}
+	return groups
+}
+
+func newTestBuilder(t *testing.T, getBlockRefs GetBlockRefsFunc) *Builder[testTask] {
+	t.Helper()
+	metrics := NewMetrics(prometheus.NewPedanticRegistry(), "loki", "bloomgateway")
+	return NewBuilder[testTask](24*time.Hour, testBounds, getBlockRefs, testPartition, metrics)
+}
+
+func TestBuilder_BuildCoalescesTasksOnSharedBlock(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	block := bloomshipper.BlockRef{MinFingerprint: 0, MaxFingerprint: 100}
+
+	b := newTestBuilder(t, func(_ context.Context, _ string, _, _ model.Time) ([]bloomshipper.BlockRef, error) {
+		return []bloomshipper.BlockRef{block}, nil
+	})
+
+	tasks := []testTask{
+		{id: "tenant-a-task", from: day, through: day, blockRef: block},
+		{id: "tenant-b-task", from: day, through: day, blockRef: block},
+	}
+
+	p, unmatched, err := b.Build(context.Background(), "fake", tasks)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(unmatched) != 0 {
+		t.Fatalf("expected no unmatched tasks, got %d", len(unmatched))
+	}
+
+	units := p.Units()
+	if len(units) != 1 {
+		t.Fatalf("expected tasks sharing a block to coalesce into a single unit, got %d units", len(units))
+	}
+	if len(units[0].Tasks) != 2 {
+		t.Fatalf("expected coalesced unit to carry both tasks, got %d", len(units[0].Tasks))
+	}
+}
+
+func TestBuilder_BuildReturnsUnmatchedWhenNoBlocks(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b := newTestBuilder(t, func(_ context.Context, _ string, _, _ model.Time) ([]bloomshipper.BlockRef, error) {
+		return nil, nil
+	})
+
+	tasks := []testTask{{id: "task", from: day, through: day}}
+
+	p, unmatched, err := b.Build(context.Background(), "fake", tasks)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(unmatched) != 1 {
+		t.Fatalf("expected the task to come back unmatched, got %d", len(unmatched))
+	}
+	if len(p.Units()) != 0 {
+		t.Fatalf("expected no units when no blocks cover the day, got %d", len(p.Units()))
+	}
+}
+
+// TestBuilder_BlockRefCacheScopedToSingleBuild verifies that the block ref
+// cache is only effective for lookups within the same Build call, not across
+// calls: a second Build for the same tenant/day must re-resolve the blocks
+// so newly compacted blocks are picked up without restarting the gateway.
+func TestBuilder_BlockRefCacheScopedToSingleBuild(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	block := bloomshipper.BlockRef{MinFingerprint: 0, MaxFingerprint: 100}
+
+	var calls int
+	b := newTestBuilder(t, func(_ context.Context, _ string, _, _ model.Time) ([]bloomshipper.BlockRef, error) {
+		calls++
+		return []bloomshipper.BlockRef{block}, nil
+	})
+
+	tasks := []testTask{
+		{id: "task-1", from: day, through: day, blockRef: block},
+		{id: "task-2", from: day, through: day, blockRef: block},
+	}
+
+	if _, _, err := b.Build(context.Background(), "fake", tasks); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single GetBlockRefs call within one Build, got %d", calls)
+	}
+
+	if _, _, err := b.Build(context.Background(), "fake", tasks); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected a second Build to re-resolve block refs instead of reusing a stale cache, got %d calls", calls)
+	}
+}
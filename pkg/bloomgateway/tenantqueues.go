@@ -0,0 +1,234 @@
+package bloomgateway
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// TenantQueues partitions the bloom query queue by tenant on top of the
+// shared queue.RequestQueue every worker still dequeues from. A single
+// tenant submitting thousands of tasks must not be able to keep every
+// worker busy with its own tasks alone, so TenantQueues:
+//
+//  1. caps how many of a tenant's tasks may be in flight (admitted but not
+//     yet closed) at once;
+//  2. holds tasks that arrive over the cap in a per-tenant pending queue
+//     instead of rejecting them outright, and later admits them via
+//     Promote once the tenant is back under its cap - so a tenant's query
+//     only fails if its own deadline expires while waiting, not merely
+//     because it was temporarily busy;
+//  3. hands out a round-robin service order, both for already-admitted
+//     tenants (ServeOrder) and for promoting pending tasks (Promote), so a
+//     tenant that dominated one batch doesn't get served first again in
+//     the next.
+//
+// All of this is shared across every worker of a gateway - fairness only
+// holds if the cap, the pending queues and the rotation are tracked
+// gateway-wide, not per-worker.
+type TenantQueues struct {
+	maxInflightPerTenant int
+
+	mu       sync.Mutex
+	inflight map[string]int
+	pending  map[string][]Task
+	rotation []string
+	cursor   int
+
+	queueLength *prometheus.GaugeVec
+}
+
+// NewTenantQueues creates a TenantQueues. A maxInflightPerTenant of 0 (or
+// less) disables the per-tenant cap, so no task is ever deferred; the
+// visibility gauge and the ServeOrder rotation still apply.
+func NewTenantQueues(maxInflightPerTenant int, registerer prometheus.Registerer, namespace, subsystem string) *TenantQueues {
+	return &TenantQueues{
+		maxInflightPerTenant: maxInflightPerTenant,
+		inflight:             make(map[string]int),
+		pending:              make(map[string][]Task),
+		queueLength: promauto.With(registerer).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queue_length",
+			Help:      "Current number of in-flight tasks enqueued for a tenant",
+		}, []string{"tenant"}),
+	}
+}
+
+// TryEnqueue admits one more task for tenant if it is still under the
+// per-tenant in-flight cap. It is called by a worker right after dequeuing
+// a task - the earliest point in the bloom gateway that can apply the cap,
+// since the task has already left the shared queue.RequestQueue by then.
+// Callers that get false back should call Defer to hold the task for later
+// admission via Promote, instead of processing it now.
+func (t *TenantQueues) TryEnqueue(tenant string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.maxInflightPerTenant > 0 && t.inflight[tenant] >= t.maxInflightPerTenant {
+		return false
+	}
+	t.inflight[tenant]++
+	t.queueLength.WithLabelValues(tenant).Set(float64(t.inflight[tenant]))
+	return true
+}
+
+// Done marks one of tenant's in-flight tasks as finished, whether it
+// completed successfully or with an error.
+func (t *TenantQueues) Done(tenant string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.inflight[tenant] > 0 {
+		t.inflight[tenant]--
+	}
+	t.queueLength.WithLabelValues(tenant).Set(float64(t.inflight[tenant]))
+}
+
+// ServeOrder returns tenants reordered so that the one least recently served
+// comes first, and advances the rotation cursor past it, so the next call -
+// from this worker or any other sharing this TenantQueues - continues the
+// rotation instead of restarting from the same tenant. This is what gives a
+// noisy tenant's tasks a turn at the back of the queue instead of always
+// being serviced first just because they fill every batch.
+func (t *TenantQueues) ServeOrder(tenants []string) []string {
+	if len(tenants) == 0 {
+		return tenants
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.learnLocked(tenants)
+
+	present := make(map[string]bool, len(tenants))
+	for _, tenant := range tenants {
+		present[tenant] = true
+	}
+
+	n := len(t.rotation)
+	ordered := make([]string, 0, len(tenants))
+	for i := 0; i < n; i++ {
+		tenant := t.rotation[(t.cursor+i)%n]
+		if present[tenant] {
+			ordered = append(ordered, tenant)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		if t.rotation[(t.cursor+i)%n] == ordered[0] {
+			t.cursor = (t.cursor + i + 1) % n
+			break
+		}
+	}
+
+	return ordered
+}
+
+// Defer holds task in tenant's pending queue instead of processing it now.
+// It is called by a worker in place of processing a task that TryEnqueue
+// rejected for being over the per-tenant in-flight cap. The task is handed
+// back to its tenant's rotation turn later, via Promote, rather than being
+// failed immediately - a tenant that is temporarily busy should not have
+// its queries rejected just because another worker picked up its batch
+// first.
+func (t *TenantQueues) Defer(task Task) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.learnLocked([]string{task.Tenant})
+	t.pending[task.Tenant] = append(t.pending[task.Tenant], task)
+}
+
+// nextPendingTenantLocked returns, in rotation order starting at the
+// cursor, the first tenant that both has pending tasks and is still under
+// its in-flight cap. t.mu must be held.
+func (t *TenantQueues) nextPendingTenantLocked() (string, bool) {
+	n := len(t.rotation)
+	for i := 0; i < n; i++ {
+		tenant := t.rotation[(t.cursor+i)%n]
+		if len(t.pending[tenant]) == 0 {
+			continue
+		}
+		if t.maxInflightPerTenant > 0 && t.inflight[tenant] >= t.maxInflightPerTenant {
+			continue
+		}
+		return tenant, true
+	}
+	return "", false
+}
+
+// Promote admits up to max previously-deferred tasks back into processing,
+// in rotation order, skipping tenants that are still over their in-flight
+// cap. This is what actually influences which tasks get worked on despite
+// queue.RequestQueue's DequeueMany having no notion of tenants itself: a
+// worker with spare capacity in a batch fills it from the tasks that were
+// deferred here, ahead of whatever else is still sitting in the shared
+// FIFO, instead of only ever reordering what DequeueMany happened to
+// return. Tasks that were cancelled while waiting in the pending queue are
+// returned separately so the caller can close them without processing.
+func (t *TenantQueues) Promote(max int) (admitted []Task, cancelled []Task) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(admitted) < max {
+		tenant, ok := t.nextPendingTenantLocked()
+		if !ok {
+			break
+		}
+
+		queue := t.pending[tenant]
+		task := queue[0]
+		queue = queue[1:]
+		if len(queue) == 0 {
+			delete(t.pending, tenant)
+		} else {
+			t.pending[tenant] = queue
+		}
+
+		if task.Err() != nil {
+			cancelled = append(cancelled, task)
+			continue
+		}
+
+		t.inflight[tenant]++
+		t.queueLength.WithLabelValues(tenant).Set(float64(t.inflight[tenant]))
+		admitted = append(admitted, task)
+	}
+
+	return admitted, cancelled
+}
+
+// FailPending fails every task still waiting in a per-tenant pending queue
+// with err and empties the queues. It is meant to be called while a
+// gateway is draining, so that tasks deferred by Defer but never promoted
+// before shutdown are not left to hang until their caller's own deadline.
+func (t *TenantQueues) FailPending(err error) {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[string][]Task)
+	t.mu.Unlock()
+
+	for _, tasks := range pending {
+		for _, task := range tasks {
+			task.ErrCh <- err
+			task.Close()
+		}
+	}
+}
+
+// learnLocked appends any tenant not already tracked in the rotation.
+// t.mu must be held.
+func (t *TenantQueues) learnLocked(tenants []string) {
+	known := make(map[string]bool, len(t.rotation))
+	for _, tenant := range t.rotation {
+		known[tenant] = true
+	}
+	for _, tenant := range tenants {
+		if !known[tenant] {
+			t.rotation = append(t.rotation, tenant)
+			known[tenant] = true
+		}
+	}
+}
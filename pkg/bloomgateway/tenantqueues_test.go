@@ -0,0 +1,180 @@
+package bloomgateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+func newTestTenantQueues(t *testing.T, maxInflightPerTenant int) *TenantQueues {
+	t.Helper()
+	return NewTenantQueues(maxInflightPerTenant, prometheus.NewPedanticRegistry(), "loki", "bloomgateway")
+}
+
+// newTestTask builds a minimal Task suitable for exercising Defer/Promote,
+// with buffered channels so sends in FailPending/the panic handler never
+// block a test.
+func newTestTask(ctx context.Context, tenant, id string) Task {
+	return Task{
+		ID:     id,
+		Tenant: tenant,
+		ctx:    ctx,
+		ErrCh:  make(chan error, 1),
+		ResCh:  make(chan v1.Output, 1),
+	}
+}
+
+func TestTenantQueues_TryEnqueueEnforcesCap(t *testing.T) {
+	tq := newTestTenantQueues(t, 2)
+
+	if !tq.TryEnqueue("a") {
+		t.Fatal("expected first task to be admitted")
+	}
+	if !tq.TryEnqueue("a") {
+		t.Fatal("expected second task to be admitted")
+	}
+	if tq.TryEnqueue("a") {
+		t.Fatal("expected third task to be rejected, over the cap")
+	}
+
+	tq.Done("a")
+	if !tq.TryEnqueue("a") {
+		t.Fatal("expected a task to be admitted again after Done frees a slot")
+	}
+}
+
+func TestTenantQueues_TryEnqueueUnboundedWhenCapDisabled(t *testing.T) {
+	tq := newTestTenantQueues(t, 0)
+
+	for i := 0; i < 1000; i++ {
+		if !tq.TryEnqueue("noisy-tenant") {
+			t.Fatalf("expected no cap to be enforced when maxInflightPerTenant is 0, rejected after %d", i)
+		}
+	}
+}
+
+func TestTenantQueues_ServeOrderRotatesAcrossCalls(t *testing.T) {
+	tq := newTestTenantQueues(t, 0)
+
+	first := tq.ServeOrder([]string{"a", "b", "c"})
+	if first[0] != "a" {
+		t.Fatalf("expected a newly learned rotation to start in first-seen order, got %v", first)
+	}
+
+	second := tq.ServeOrder([]string{"a", "b", "c"})
+	if second[0] != "b" {
+		t.Fatalf("expected rotation to continue past the tenant served first last time, got %v", second)
+	}
+
+	third := tq.ServeOrder([]string{"a", "b", "c"})
+	if third[0] != "c" {
+		t.Fatalf("expected rotation to keep advancing, got %v", third)
+	}
+
+	fourth := tq.ServeOrder([]string{"a", "b", "c"})
+	if fourth[0] != "a" {
+		t.Fatalf("expected rotation to wrap back around to the start, got %v", fourth)
+	}
+}
+
+func TestTenantQueues_ServeOrderSkipsAbsentTenants(t *testing.T) {
+	tq := newTestTenantQueues(t, 0)
+
+	tq.ServeOrder([]string{"a", "b", "c"})
+
+	// Only "a" and "c" are present in this batch; "b" (next in the rotation)
+	// must be skipped rather than block the order.
+	ordered := tq.ServeOrder([]string{"a", "c"})
+	if len(ordered) != 2 || ordered[0] != "c" {
+		t.Fatalf("expected rotation to skip a tenant absent from this batch, got %v", ordered)
+	}
+}
+
+func TestTenantQueues_DeferAndPromoteAdmitsOnceUnderCap(t *testing.T) {
+	tq := newTestTenantQueues(t, 1)
+
+	if !tq.TryEnqueue("a") {
+		t.Fatal("expected first task for tenant a to be admitted")
+	}
+
+	overflow := newTestTask(context.Background(), "a", "task-over-cap")
+	tq.Defer(overflow)
+
+	// Tenant "a" is still at its cap, so nothing should promote yet.
+	admitted, cancelled := tq.Promote(10)
+	if len(admitted) != 0 || len(cancelled) != 0 {
+		t.Fatalf("expected nothing to promote while tenant is still at cap, got admitted=%v cancelled=%v", admitted, cancelled)
+	}
+
+	tq.Done("a")
+
+	admitted, cancelled = tq.Promote(10)
+	if len(cancelled) != 0 {
+		t.Fatalf("expected no cancelled tasks, got %v", cancelled)
+	}
+	if len(admitted) != 1 || admitted[0].ID != "task-over-cap" {
+		t.Fatalf("expected the deferred task to be promoted once a slot freed up, got %v", admitted)
+	}
+}
+
+func TestTenantQueues_PromoteRespectsMaxAndSkipsTenantsStillOverCap(t *testing.T) {
+	tq := newTestTenantQueues(t, 1)
+
+	tq.TryEnqueue("busy") // fills busy's only slot
+	tq.Defer(newTestTask(context.Background(), "busy", "busy-task"))
+	tq.Defer(newTestTask(context.Background(), "free", "free-task"))
+
+	admitted, cancelled := tq.Promote(10)
+	if len(cancelled) != 0 {
+		t.Fatalf("expected no cancelled tasks, got %v", cancelled)
+	}
+	if len(admitted) != 1 || admitted[0].ID != "free-task" {
+		t.Fatalf("expected only the task for the tenant under cap to promote, got %v", admitted)
+	}
+}
+
+func TestTenantQueues_PromoteSeparatesCancelledTasks(t *testing.T) {
+	tq := newTestTenantQueues(t, 0)
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tq.Defer(newTestTask(cancelledCtx, "a", "cancelled-task"))
+	tq.Defer(newTestTask(context.Background(), "a", "live-task"))
+
+	admitted, cancelled := tq.Promote(10)
+	if len(admitted) != 1 || admitted[0].ID != "live-task" {
+		t.Fatalf("expected the live task to be admitted, got %v", admitted)
+	}
+	if len(cancelled) != 1 || cancelled[0].ID != "cancelled-task" {
+		t.Fatalf("expected the cancelled task to be returned separately, got %v", cancelled)
+	}
+}
+
+func TestTenantQueues_FailPendingFailsAllWaitingTasks(t *testing.T) {
+	tq := newTestTenantQueues(t, 1)
+	tq.TryEnqueue("a")
+
+	task := newTestTask(context.Background(), "a", "waiting-task")
+	tq.Defer(task)
+
+	failErr := errors.New("gateway draining")
+	tq.FailPending(failErr)
+
+	select {
+	case err := <-task.ErrCh:
+		if err != failErr {
+			t.Fatalf("expected task to fail with %v, got %v", failErr, err)
+		}
+	default:
+		t.Fatal("expected pending task to receive an error")
+	}
+
+	admitted, cancelled := tq.Promote(10)
+	if len(admitted) != 0 || len(cancelled) != 0 {
+		t.Fatalf("expected no pending tasks left to promote after FailPending, got admitted=%v cancelled=%v", admitted, cancelled)
+	}
+}
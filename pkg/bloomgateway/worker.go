@@ -3,17 +3,21 @@ package bloomgateway
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/services"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slices"
 
+	"github.com/grafana/loki/pkg/bloomgateway/plan"
 	"github.com/grafana/loki/pkg/queue"
 	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
 	"github.com/grafana/loki/pkg/storage/stores/shipper/bloomshipper"
@@ -28,19 +32,23 @@ type workerMetrics struct {
 	dequeuedTasks      *prometheus.CounterVec
 	dequeueErrors      *prometheus.CounterVec
 	dequeueWaitTime    *prometheus.SummaryVec
-	storeAccessLatency *prometheus.HistogramVec
 	bloomQueryLatency  *prometheus.HistogramVec
+	storeAccessLatency *prometheus.HistogramVec
+	workerPanics       *prometheus.CounterVec
+	drainDuration      *prometheus.HistogramVec
+	drainedTasks       *prometheus.CounterVec
 }
 
 func newWorkerMetrics(registerer prometheus.Registerer, namespace, subsystem string) *workerMetrics {
 	labels := []string{"worker"}
+	tenantLabels := []string{"worker", "tenant"}
 	return &workerMetrics{
 		dequeuedTasks: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "dequeued_tasks_total",
 			Help:      "Total amount of tasks that the worker dequeued from the bloom query queue",
-		}, labels),
+		}, tenantLabels),
 		dequeueErrors: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
@@ -52,23 +60,61 @@ func newWorkerMetrics(registerer prometheus.Registerer, namespace, subsystem str
 			Subsystem: subsystem,
 			Name:      "dequeue_wait_time",
 			Help:      "Time spent waiting for dequeuing tasks from queue",
-		}, labels),
+		}, tenantLabels),
 		bloomQueryLatency: promauto.With(registerer).NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "bloom_query_latency",
 			Help:      "Latency in seconds of processing bloom blocks",
-		}, append(labels, "status")),
-		// TODO(chaudum): Move this metric into the bloomshipper
+		}, append(tenantLabels, "status")),
 		storeAccessLatency: promauto.With(registerer).NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "store_latency",
 			Help:      "Latency in seconds of accessing the bloom store component",
-		}, append(labels, "operation")),
+		}, append(tenantLabels, "operation")),
+		workerPanics: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "worker_panics_total",
+			Help:      "Total amount of panics recovered from in the worker loop",
+		}, labels),
+		drainDuration: promauto.With(registerer).NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "worker_drain_duration_seconds",
+			Help:      "Time spent waiting for a worker to drain its in-flight batch",
+		}, labels),
+		drainedTasks: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "worker_drained_tasks_total",
+			Help:      "Total amount of tasks that were completed while the worker was draining",
+		}, labels),
 	}
 }
 
+// taskQueue is the subset of *queue.RequestQueue a worker depends on.
+// Depending on this instead of the concrete type lets the dequeue/panic
+// recovery path in runOne be exercised against a fake queue in tests.
+type taskQueue interface {
+	RegisterConsumerConnection(consumerID string)
+	UnregisterConsumerConnection(consumerID string)
+	DequeueMany(ctx context.Context, idx queue.Index, consumerID string, maxItems int, maxWait time.Duration) ([]interface{}, queue.Index, error)
+	ReleaseRequests(items []interface{})
+}
+
+// taskTracker is the subset of *pendingTasks a worker depends on.
+type taskTracker interface {
+	Delete(id string)
+}
+
+// blockFetcher is the subset of bloomshipper.Interface a worker depends on
+// to run queries against the blocks covering a batch of tasks.
+type blockFetcher interface {
+	Fetch(ctx context.Context, tenant string, blocks []bloomshipper.BlockRef, callback func(bq *v1.BlockQuerier, minFp, maxFp uint64) error) error
+}
+
 // worker is a datastructure that consumes tasks from the request queue,
 // processes them and returns the result/error back to the response channels of
 // the tasks.
@@ -77,258 +123,485 @@ func newWorkerMetrics(registerer prometheus.Registerer, namespace, subsystem str
 type worker struct {
 	services.Service
 
-	id      string
-	cfg     workerConfig
-	queue   *queue.RequestQueue
-	shipper bloomshipper.Interface
-	tasks   *pendingTasks
-	logger  log.Logger
-	metrics *workerMetrics
+	id           string
+	cfg          workerConfig
+	queue        taskQueue
+	shipper      blockFetcher
+	tasks        taskTracker
+	tenantQueues *TenantQueues
+	logger       *slog.Logger
+	metrics      *workerMetrics
+	planner      *plan.Builder[Task]
+
+	draining atomic.Bool
+	stopped  chan struct{}
 }
 
-func newWorker(id string, cfg workerConfig, queue *queue.RequestQueue, shipper bloomshipper.Interface, tasks *pendingTasks, logger log.Logger, metrics *workerMetrics) *worker {
+// newWorker creates a worker. planner and tenantQueues are expected to be
+// shared across all workers of a gateway: planner so its metrics are only
+// registered once, and tenantQueues so that the per-tenant in-flight count
+// it tracks reflects every worker, not just this one.
+func newWorker(id string, cfg workerConfig, queue taskQueue, shipper blockFetcher, tasks taskTracker, planner *plan.Builder[Task], tenantQueues *TenantQueues, logger *slog.Logger, metrics *workerMetrics) *worker {
 	w := &worker{
-		id:      id,
-		cfg:     cfg,
-		queue:   queue,
-		shipper: shipper,
-		tasks:   tasks,
-		logger:  log.With(logger, "worker", id),
-		metrics: metrics,
+		id:           id,
+		cfg:          cfg,
+		queue:        queue,
+		shipper:      shipper,
+		tasks:        tasks,
+		planner:      planner,
+		tenantQueues: tenantQueues,
+		logger:       logger.With("worker", id),
+		metrics:      metrics,
+		stopped:      make(chan struct{}),
 	}
 	w.Service = services.NewBasicService(w.starting, w.running, w.stopping).WithName(id)
+
+	// dskit's services.Service still logs unexpected Failed transitions
+	// through a go-kit log.Logger, not slog - bridge this worker's logger
+	// so a crashed service is reported through the same structured logger
+	// as everything else the worker logs, instead of going to a separate,
+	// unconfigured go-kit default logger.
+	goKitLogger := newGoKitLogger(w.logger)
+	w.Service.AddListener(services.NewListener(
+		nil, nil, nil, nil,
+		func(from services.State, failure error) {
+			level.Error(goKitLogger).Log("msg", "worker service failed", "from", from, "err", failure)
+		},
+	))
+
 	return w
 }
 
 func (w *worker) starting(_ context.Context) error {
-	level.Debug(w.logger).Log("msg", "starting worker")
+	w.logger.Debug("starting worker")
 	w.queue.RegisterConsumerConnection(w.id)
 	return nil
 }
 
 func (w *worker) running(ctx context.Context) error {
 	idx := queue.StartIndexWithLocalQueue
+	defer close(w.stopped)
 
 	for {
+		if w.draining.Load() {
+			w.logger.Debug("worker drained, exiting run loop")
+			return nil
+		}
+
 		select {
 
 		case <-ctx.Done():
 			return errors.Wrapf(ctx.Err(), "shutting down worker %s", w.id)
 
 		default:
-			iterationCtx := context.Background()
-			dequeueStart := time.Now()
-			items, newIdx, err := w.queue.DequeueMany(iterationCtx, idx, w.id, w.cfg.maxItems, w.cfg.maxWaitTime)
-			w.metrics.dequeueWaitTime.WithLabelValues(w.id).Observe(time.Since(dequeueStart).Seconds())
+			newIdx, err := w.runOne(ctx, idx)
 			if err != nil {
-				// We only return an error if the queue is stopped and dequeuing did not yield any items
-				if err == queue.ErrStopped && len(items) == 0 {
-					level.Error(w.logger).Log("msg", "queue is stopped")
-					return err
-				}
-				w.metrics.dequeueErrors.WithLabelValues(w.id).Inc()
-				level.Error(w.logger).Log("msg", "failed to dequeue tasks", "err", err, "items", len(items))
+				return err
 			}
 			idx = newIdx
+		}
+	}
+}
 
-			if len(items) == 0 {
-				w.queue.ReleaseRequests(items)
-				continue
-			}
-			w.metrics.dequeuedTasks.WithLabelValues(w.id).Add(float64(len(items)))
+// Drain stops the worker from dequeuing new batches and waits, up to the
+// deadline carried by ctx, for the batch it is currently processing to
+// finish: results and errors sent to every task's channel and the channel
+// closed. This allows rolling restarts and Kubernetes preStop hooks to let
+// outstanding filter queries complete instead of dropping them on the floor
+// and forcing clients to retry.
+func (w *worker) Drain(ctx context.Context) error {
+	start := time.Now()
+	w.logger.Info("draining worker")
 
-			tasksByDay := make(map[time.Time][]Task)
+	w.draining.Store(true)
+	w.queue.UnregisterConsumerConnection(w.id)
 
+	select {
+	case <-w.stopped:
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "draining worker %s", w.id)
+	}
+
+	w.metrics.drainDuration.WithLabelValues(w.id).Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// finishedSet guards against finishing the same task twice. It backs
+// runOne's panic handler: a task that was already closed earlier in the
+// same batch (e.g. because it was cancelled while waiting in the queue)
+// must not be replayed - sending on / closing its channels again is itself
+// a panic, and one that would escape the handler's own recover and crash
+// the worker.
+type finishedSet map[string]bool
+
+// finish marks id as finished and reports whether this is the first time,
+// i.e. whether the caller is the one that should actually close it.
+func (f finishedSet) finish(id string) bool {
+	if f[id] {
+		return false
+	}
+	f[id] = true
+	return true
+}
+
+// runOne dequeues and processes a single batch of tasks. A panic anywhere in
+// the processing path (including the shipper callback invoked from
+// processBlocksWithCallback) is recovered here so that a single corrupted
+// block or unexpected nil cannot take down the whole worker: the panic is
+// logged together with its stack trace, surfaced as an error to every task
+// of the in-flight batch, and the dequeued items are still released back to
+// the queue before the worker moves on to the next iteration.
+func (w *worker) runOne(ctx context.Context, idx queue.Index) (newIdx queue.Index, err error) {
+	newIdx = idx
+	var items []interface{}
+	var promoted []Task
+	finished := make(finishedSet)
+
+	defer func() {
+		if r := recover(); r != nil {
+			w.metrics.workerPanics.WithLabelValues(w.id).Inc()
+			w.logger.Error("panic processing tasks, worker will continue", "panic", r, "stack", string(debug.Stack()))
+			panicErr := errors.Errorf("panic processing tasks: %v", r)
 			for _, item := range items {
-				if item == nil {
-					// this should never happen, but it's a safety measure
-					w.queue.ReleaseRequests(items)
-					return errors.New("dequeued item is nil")
-				}
 				task, ok := item.(Task)
-				if !ok {
-					// This really should never happen, because only the bloom gateway itself can enqueue tasks.
-					w.queue.ReleaseRequests(items)
-					return errors.Errorf("failed to cast dequeued item to Task: %v", item)
+				if !ok || !finished.finish(task.ID) {
+					continue
 				}
-				level.Debug(w.logger).Log("msg", "dequeued task", "task", task.ID, "closed", task.closed)
-				w.tasks.Delete(task.ID)
-
-				// check if task was already cancelled while it was waiting in the queue
-				if task.Err() != nil {
-					level.Debug(w.logger).Log("msg", "skipping cancelled task", "task", task.ID, "err", task.Err())
-					task.Close()
+				task.ErrCh <- panicErr
+				task.Close()
+				w.tenantQueues.Done(task.Tenant)
+			}
+			for _, task := range promoted {
+				if !finished.finish(task.ID) {
 					continue
 				}
+				task.ErrCh <- panicErr
+				task.Close()
+				w.tenantQueues.Done(task.Tenant)
+			}
+			w.queue.ReleaseRequests(items)
+			err = nil
+		}
+	}()
 
-				fromDay, throughDay := task.Bounds()
+	iterationCtx := context.Background()
+	dequeueStart := time.Now()
+	var dequeueErr error
+	items, newIdx, dequeueErr = w.queue.DequeueMany(iterationCtx, idx, w.id, w.cfg.maxItems, w.cfg.maxWaitTime)
+	dequeueWait := time.Since(dequeueStart)
+	if dequeueErr != nil {
+		// We only return an error if the queue is stopped and dequeuing did not yield any items
+		if dequeueErr == queue.ErrStopped && len(items) == 0 {
+			w.logger.Error("queue is stopped")
+			return newIdx, dequeueErr
+		}
+		w.metrics.dequeueErrors.WithLabelValues(w.id).Inc()
+		w.logger.Error("failed to dequeue tasks", "err", dequeueErr, "items", len(items))
+	}
 
-				if fromDay.Equal(throughDay) {
-					tasksByDay[fromDay] = append(tasksByDay[fromDay], task)
-				} else {
-					level.Debug(w.logger).Log("msg", "task spans across multiple days", "from", fromDay, "through", throughDay)
-					for i := fromDay; i.Before(throughDay); i = i.Add(Day) {
-						tasksByDay[i] = append(tasksByDay[i], task)
-					}
-				}
-			}
+	// Fill whatever of this batch's capacity the shared queue.RequestQueue
+	// didn't use with tasks previously deferred by TryEnqueue because their
+	// tenant was over its in-flight cap. DequeueMany itself has no notion of
+	// tenants, so this is the point where per-tenant fairness actually
+	// influences what gets processed, rather than just reordering whatever
+	// DequeueMany happened to return.
+	if budget := w.cfg.maxItems - len(items); budget > 0 {
+		var promotedCancelled []Task
+		promoted, promotedCancelled = w.tenantQueues.Promote(budget)
+		for _, task := range promotedCancelled {
+			w.logger.Debug("skipping cancelled task", "task_id", task.ID, "tenant", task.Tenant, "err", task.Err())
+			task.Close()
+			finished.finish(task.ID)
+		}
+	}
 
-			for day, tasks := range tasksByDay {
-				logger := log.With(w.logger, "day", day)
-				level.Debug(logger).Log("msg", "tasks per day", "tasks_len", len(tasks))
-				for _, task := range tasks {
-					level.Debug(w.logger).Log("msg", "individual task", "task", task.ID, "closed", task.closed)
-				}
+	if len(items) == 0 && len(promoted) == 0 {
+		w.queue.ReleaseRequests(items)
+		return newIdx, nil
+	}
 
-				// Remove tasks that are already cancelled
-				tasks = slices.DeleteFunc(tasks, func(t Task) bool {
-					return t.Err() != nil
-				})
-				level.Debug(logger).Log("msg", "not cancelled tasks per day", "tasks_len", len(tasks))
-				// no tasks to process, continue with next day
-				if len(tasks) == 0 {
-					level.Debug(logger).Log("msg", "no tasks to process, continue with next day")
-					continue
-				}
+	tasksByTenant := make(map[string][]Task)
+	for _, task := range promoted {
+		tasksByTenant[task.Tenant] = append(tasksByTenant[task.Tenant], task)
+	}
 
-				level.Debug(logger).Log("msg", "process tasks", "tasks", len(tasks))
+	for _, item := range items {
+		if item == nil {
+			// this should never happen, but it's a safety measure
+			w.queue.ReleaseRequests(items)
+			return newIdx, errors.New("dequeued item is nil")
+		}
+		task, ok := item.(Task)
+		if !ok {
+			// This really should never happen, because only the bloom gateway itself can enqueue tasks.
+			w.queue.ReleaseRequests(items)
+			return newIdx, errors.Errorf("failed to cast dequeued item to Task: %v", item)
+		}
+		w.logger.Debug("dequeued task", "task_id", task.ID, "tenant", task.Tenant, "trace_id", taskTraceID(task), "closed", task.closed)
+		w.tasks.Delete(task.ID)
+
+		// check if task was already cancelled while it was waiting in the queue
+		if task.Err() != nil {
+			w.logger.Debug("skipping cancelled task", "task_id", task.ID, "tenant", task.Tenant, "err", task.Err())
+			task.Close()
+			finished.finish(task.ID)
+			continue
+		}
 
-				storeFetchStart := time.Now()
-				blockRefs, err := w.shipper.GetBlockRefs(iterationCtx, tasks[0].Tenant, toModelTime(day), toModelTime(day.Add(Day).Add(-1*time.Nanosecond)))
-				w.metrics.storeAccessLatency.WithLabelValues(w.id, "GetBlockRefs").Observe(time.Since(storeFetchStart).Seconds())
-				if err != nil {
-					level.Debug(logger).Log("msg", "error processing tasks. notifying all task's channels and go to the next day", "err", err)
-					// send error to error channel of each task
-					for _, t := range tasks {
-						t.ErrCh <- err
-					}
-					// continue with tasks of next day
-					continue
-				}
-				// No blocks found.
-				// Since there are no blocks for the given tasks, we need to return the
-				// unfiltered list of chunk refs.
-				if len(blockRefs) == 0 {
-					level.Warn(logger).Log("msg", "no blocks found")
-					for _, t := range tasks {
-						for _, ref := range t.Request.Refs {
-							t.ResCh <- v1.Output{
-								Fp:       model.Fingerprint(ref.Fingerprint),
-								Removals: nil,
-							}
-						}
-					}
-					// continue with tasks of next day
-					continue
-				}
+		// Admission control: this is the earliest point a worker can apply
+		// the per-tenant in-flight cap, since tasks are already dequeued
+		// from the shared queue by the time we see them. A tenant over its
+		// cap is deferred rather than failed outright: TenantQueues holds
+		// the task and Promote hands it back, in rotation order, to
+		// whichever worker next has spare batch capacity for that tenant -
+		// so one noisy tenant flooding the queue cannot hold every worker's
+		// processing slots for itself, but its tasks still complete rather
+		// than erroring just because they arrived while the tenant was busy.
+		if !w.tenantQueues.TryEnqueue(task.Tenant) {
+			w.logger.Debug("deferring task, tenant exceeded max in-flight", "task_id", task.ID, "tenant", task.Tenant)
+			w.tenantQueues.Defer(task)
+			finished.finish(task.ID)
+			continue
+		}
 
-				partitionedTasks := partitionFingerprintRange(tasks, blockRefs)
-				level.Debug(logger).Log("msg", "partitioned tasks", "regular", len(tasks), "partitioned", len(partitionedTasks))
+		tasksByTenant[task.Tenant] = append(tasksByTenant[task.Tenant], task)
+	}
 
-				err = w.processBlocksWithCallback(iterationCtx, tasks[0].Tenant, day, partitionedTasks)
-				if err != nil {
-					level.Error(logger).Log("msg", "processed with an error", "err", err)
-					// send error to error channel of each task
-					for _, t := range tasks {
-						t.ErrCh <- err
+	for tenant, tasks := range tasksByTenant {
+		w.metrics.dequeuedTasks.WithLabelValues(w.id, tenant).Add(float64(len(tasks)))
+		w.metrics.dequeueWaitTime.WithLabelValues(w.id, tenant).Observe(dequeueWait.Seconds())
+	}
+
+	// Service tenants in round-robin order rather than Go's unspecified map
+	// iteration order: tenantQueues remembers which tenant was served last
+	// (across every worker, since it's shared gateway-wide) and rotates past
+	// it, so a tenant that dominated one batch is served last in the next
+	// rather than first again.
+	tenants := make([]string, 0, len(tasksByTenant))
+	for tenant := range tasksByTenant {
+		tenants = append(tenants, tenant)
+	}
+	tenants = w.tenantQueues.ServeOrder(tenants)
+
+	for _, tenant := range tenants {
+		tasks := tasksByTenant[tenant]
+		logger := w.logger.With("tenant", tenant, "trace_id", batchTraceID(tasks))
+		logger.Debug("tasks per tenant", "tasks_len", len(tasks))
+
+		// Remove tasks that are already cancelled
+		tasks = slices.DeleteFunc(tasks, func(t Task) bool {
+			return t.Err() != nil
+		})
+		if len(tasks) == 0 {
+			logger.Debug("no tasks to process, continue with next tenant")
+			continue
+		}
+
+		logger.Debug("building execution plan", "tasks", len(tasks))
+
+		execPlan, unmatched, err := w.planner.Build(iterationCtx, tenant, tasks)
+		if err != nil {
+			logger.Debug("error building execution plan, notifying all task's channels and go to the next tenant", "err", err)
+			for _, t := range tasks {
+				t.ErrCh <- err
+			}
+			continue
+		}
+
+		// No blocks found for some of the tasks' days.
+		// Since there are no blocks for the given tasks, we need to return the
+		// unfiltered list of chunk refs.
+		if len(unmatched) > 0 {
+			logger.Warn("no blocks found", "tasks", len(unmatched))
+			for _, t := range unmatched {
+				for _, ref := range t.Request.Refs {
+					t.ResCh <- v1.Output{
+						Fp:       model.Fingerprint(ref.Fingerprint),
+						Removals: nil,
 					}
-					// continue with tasks of next day
-					continue
 				}
 			}
+		}
 
-			// close channels because everything is sent
-			for _, tasks := range tasksByDay {
-				for _, task := range tasks {
-					level.Debug(w.logger).Log("msg", "close task", "task", task.ID, "closed", task.closed)
-					task.Close()
-				}
+		units := execPlan.Units()
+		logger.Debug("execution plan", "tasks", len(tasks), "units", len(units))
+		if len(units) == 0 {
+			continue
+		}
+
+		err = w.processBlocksWithCallback(iterationCtx, tenant, units)
+		if err != nil {
+			logger.Error("processed with an error", "err", err)
+			// send error to error channel of each task
+			for _, t := range tasks {
+				t.ErrCh <- err
 			}
+			continue
+		}
+	}
 
-			// return dequeued items back to the pool
-			w.queue.ReleaseRequests(items)
+	// close channels because everything is sent
+	drained := w.draining.Load()
+	for tenant, tasks := range tasksByTenant {
+		for _, task := range tasks {
+			w.logger.Debug("close task", "task_id", task.ID, "tenant", tenant, "closed", task.closed)
+			task.Close()
+			finished.finish(task.ID)
+			w.tenantQueues.Done(tenant)
+			if drained {
+				w.metrics.drainedTasks.WithLabelValues(w.id).Inc()
+			}
 		}
 	}
+
+	// return dequeued items back to the pool
+	w.queue.ReleaseRequests(items)
+	return newIdx, nil
 }
 
 func (w *worker) stopping(err error) error {
-	level.Debug(w.logger).Log("msg", "stopping worker", "err", err)
+	w.logger.Debug("stopping worker", "err", err)
+	// If the worker already drained, the consumer connection was unregistered
+	// as part of Drain and its current batch has already been dealt with.
+	if w.draining.Load() {
+		return nil
+	}
 	w.queue.UnregisterConsumerConnection(w.id)
 	return nil
 }
 
-func (w *worker) processBlocksWithCallback(ctx context.Context, tenant string, day time.Time, partitionedTasks []boundedTasks) error {
-	logger := log.With(w.logger, "worker", w.id)
-	level.Debug(logger).Log("msg", "processBlocksWithCallback")
-	defer func() {
-		level.Debug(logger).Log("msg", "leaving processBlocksWithCallback")
-	}()
-	blockRefs := make([]bloomshipper.BlockRef, 0, len(partitionedTasks))
-	for _, pt := range partitionedTasks {
-		blockRefs = append(blockRefs, pt.blockRef)
+func (w *worker) processBlocksWithCallback(ctx context.Context, tenant string, units []plan.Unit[Task]) error {
+	logger := w.logger.With("tenant", tenant, "trace_id", unitsTraceID(units))
+	logger.Debug("processBlocksWithCallback")
+	defer logger.Debug("leaving processBlocksWithCallback")
+
+	blockRefs := make([]bloomshipper.BlockRef, 0, len(units))
+	for _, u := range units {
+		blockRefs = append(blockRefs, u.BlockRef)
 	}
-	return w.shipper.Fetch(ctx, tenant, blockRefs, func(bq *v1.BlockQuerier, minFp, maxFp uint64) error {
-		logger := log.With(w.logger, "worker", w.id)
-		level.Debug(logger).Log("msg", "inside callback")
+
+	fetchStart := time.Now()
+	err := w.shipper.Fetch(ctx, tenant, blockRefs, func(bq *v1.BlockQuerier, minFp, maxFp uint64) (err error) {
+		logger := logger.With("block_min_fp", minFp, "block_max_fp", maxFp)
+		logger.Debug("inside callback")
 		defer func() {
-			level.Debug(logger).Log("msg", "leaving callback")
+			if r := recover(); r != nil {
+				w.metrics.workerPanics.WithLabelValues(w.id).Inc()
+				logger.Error("panic processing block, skipping it", "panic", r, "stack", string(debug.Stack()))
+				err = errors.Errorf("panic processing block %x-%x: %v", minFp, maxFp, r)
+			}
+			logger.Debug("leaving callback")
 		}()
-		for _, pt := range partitionedTasks {
-			if pt.blockRef.MinFingerprint == minFp && pt.blockRef.MaxFingerprint == maxFp {
-				return w.processBlock(ctx, bq, day, pt.tasks)
+		for _, u := range units {
+			if u.BlockRef.MinFingerprint == minFp && u.BlockRef.MaxFingerprint == maxFp {
+				return w.processBlock(ctx, bq, tenant, u.Day, u.Tasks)
 			}
 		}
 		return fmt.Errorf("no overlapping blocks for range %x-%x", minFp, maxFp)
 	})
+	w.metrics.storeAccessLatency.WithLabelValues(w.id, tenant, "Fetch").Observe(time.Since(fetchStart).Seconds())
+	return err
 }
 
-func (w *worker) processBlock(ctx context.Context, blockQuerier *v1.BlockQuerier, day time.Time, tasks []Task) error {
-	logger := log.With(w.logger, "worker", w.id)
-	level.Debug(logger).Log("msg", "start processBlock")
-	defer func() {
-		level.Debug(logger).Log("msg", "end processBlock")
-	}()
+func (w *worker) processBlock(ctx context.Context, blockQuerier *v1.BlockQuerier, tenant string, day time.Time, tasks []Task) error {
+	nRefs := 0
+	for _, t := range tasks {
+		nRefs += len(t.Request.Refs)
+	}
+	logger := w.logger.With("tenant", tenant, "day", day, "trace_id", batchTraceID(tasks), "n_refs", nRefs)
+	logger.Debug("start processBlock")
+	defer logger.Debug("end processBlock")
 
 	schema, err := blockQuerier.Schema()
 	if err != nil {
 		return err
 	}
 
-	level.Debug(logger).Log("msg", "creating tokenizer")
+	logger.Debug("creating tokenizer")
 	tokenizer := v1.NewNGramTokenizer(schema.NGramLen(), 0)
-	level.Debug(logger).Log("msg", "creating taskMergeIterator")
+	logger.Debug("creating taskMergeIterator")
 	it := newTaskMergeIterator(day, tokenizer, tasks...)
-	level.Debug(logger).Log("msg", "Fuse")
+	logger.Debug("Fuse")
 	fq := blockQuerier.Fuse([]v1.PeekingIterator[v1.Request]{it})
 
 	if ctx.Err() != nil {
-		level.Debug(logger).Log("msg", "context error", "err", err)
+		logger.Debug("context error", "err", ctx.Err())
 		return ctx.Err()
 	}
 
 	for _, t := range tasks {
 		if t.Err() != nil {
-			level.Debug(logger).Log("msg", "task context error", "task", t.ID, "err", t.Err())
+			logger.Debug("task context error", "task_id", t.ID, "err", t.Err())
 			return t.ctx.Err()
 		}
 	}
 
 	start := time.Now()
-	level.Debug(logger).Log("msg", "before fq.Run()")
+	logger.Debug("before fq.Run()")
 	err = fq.Run()
-	level.Debug(logger).Log("msg", "after fq.Run()")
+	logger.Debug("after fq.Run()")
 	duration := time.Since(start).Seconds()
 
 	if err != nil {
-		level.Debug(logger).Log("msg", "completed with error", "err", err)
-		w.metrics.bloomQueryLatency.WithLabelValues(w.id, "failure").Observe(duration)
+		logger.Debug("completed with error", "err", err)
+		w.metrics.bloomQueryLatency.WithLabelValues(w.id, tenant, "failure").Observe(duration)
 		return err
 	}
 
-	w.metrics.bloomQueryLatency.WithLabelValues(w.id, "success").Observe(duration)
+	w.metrics.bloomQueryLatency.WithLabelValues(w.id, tenant, "success").Observe(duration)
 	return nil
 }
 
+// traceID extracts the OpenTelemetry trace ID from ctx, if any is recorded.
+// iterationCtx (the context.Background used around the dequeue loop itself)
+// never carries a span, so callers that want a per-task trace ID must pass
+// a task's own context, not the shared loop context.
+func traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// taskTraceID returns the trace ID carried by a single task's own context.
+func taskTraceID(t Task) string {
+	return traceID(t.ctx)
+}
+
+// batchTraceID picks a representative trace ID for a log line that spans a
+// batch of tasks which may have been coalesced from different requests (and
+// therefore different traces). It is best-effort: the first task's trace is
+// used for correlation.
+func batchTraceID(tasks []Task) string {
+	if len(tasks) == 0 {
+		return ""
+	}
+	return taskTraceID(tasks[0])
+}
+
+// unitsTraceID picks a representative trace ID for a log line spanning a set
+// of execution plan units, using the first task found in any unit.
+func unitsTraceID(units []plan.Unit[Task]) string {
+	for _, u := range units {
+		if len(u.Tasks) > 0 {
+			return batchTraceID(u.Tasks)
+		}
+	}
+	return ""
+}
+
 func toModelTime(t time.Time) model.Time {
 	return model.TimeFromUnixNano(t.UnixNano())
 }
+
+// partitionTasks adapts partitionFingerprintRange to plan.PartitionFunc so it
+// can be used by a plan.Builder[Task].
+func partitionTasks(tasks []Task, blocks []bloomshipper.BlockRef) []plan.Group[Task] {
+	bounded := partitionFingerprintRange(tasks, blocks)
+	groups := make([]plan.Group[Task], 0, len(bounded))
+	for _, bt := range bounded {
+		groups = append(groups, plan.Group[Task]{BlockRef: bt.blockRef, Tasks: bt.tasks})
+	}
+	return groups
+}
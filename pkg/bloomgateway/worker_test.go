@@ -0,0 +1,191 @@
+package bloomgateway
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/bloomgateway/plan"
+	"github.com/grafana/loki/pkg/queue"
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/bloomshipper"
+)
+
+func TestFinishedSet(t *testing.T) {
+	f := make(finishedSet)
+
+	if !f.finish("task-a") {
+		t.Fatal("expected first finish of task-a to succeed")
+	}
+	if f.finish("task-a") {
+		t.Fatal("expected second finish of task-a to report already finished")
+	}
+	if !f.finish("task-b") {
+		t.Fatal("expected first finish of a different task to succeed")
+	}
+}
+
+// fakeWorkerQueue is a taskQueue that serves a fixed sequence of batches,
+// one per call to DequeueMany, and records every batch ReleaseRequests is
+// called with.
+type fakeWorkerQueue struct {
+	mu           sync.Mutex
+	batches      [][]interface{}
+	call         int
+	released     [][]interface{}
+	afterDequeue func()
+}
+
+func (f *fakeWorkerQueue) RegisterConsumerConnection(string)   {}
+func (f *fakeWorkerQueue) UnregisterConsumerConnection(string) {}
+
+func (f *fakeWorkerQueue) DequeueMany(_ context.Context, idx queue.Index, _ string, _ int, _ time.Duration) ([]interface{}, queue.Index, error) {
+	f.mu.Lock()
+	var items []interface{}
+	if f.call < len(f.batches) {
+		items = f.batches[f.call]
+	}
+	f.call++
+	f.mu.Unlock()
+
+	if f.afterDequeue != nil {
+		f.afterDequeue()
+	}
+	return items, idx, nil
+}
+
+func (f *fakeWorkerQueue) ReleaseRequests(items []interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.released = append(f.released, items)
+}
+
+// panickingShipper simulates a panic surfacing from the shipper while a
+// worker is processing a batch, e.g. a corrupted block or an unexpected
+// nil deep in the fetch path.
+type panickingShipper struct{}
+
+func (panickingShipper) Fetch(context.Context, string, []bloomshipper.BlockRef, func(*v1.BlockQuerier, uint64, uint64) error) error {
+	panic("simulated shipper panic")
+}
+
+type noopTaskTracker struct{}
+
+func (noopTaskTracker) Delete(string) {}
+
+func newTestPlanner(t *testing.T) *plan.Builder[Task] {
+	t.Helper()
+	block := bloomshipper.BlockRef{MinFingerprint: 0, MaxFingerprint: 100}
+	bounds := func(Task) plan.Bounds { return plan.Bounds{} }
+	getBlockRefs := func(_ context.Context, _ string, _, _ model.Time) ([]bloomshipper.BlockRef, error) {
+		return []bloomshipper.BlockRef{block}, nil
+	}
+	partition := func(tasks []Task, blocks []bloomshipper.BlockRef) []plan.Group[Task] {
+		if len(blocks) == 0 {
+			return nil
+		}
+		return []plan.Group[Task]{{BlockRef: blocks[0], Tasks: tasks}}
+	}
+	metrics := plan.NewMetrics(prometheus.NewPedanticRegistry(), "loki", "bloomgateway")
+	return plan.NewBuilder[Task](24*time.Hour, bounds, getBlockRefs, partition, metrics)
+}
+
+// TestWorker_RunOneSurvivesShipperPanic drives runOne through a batch whose
+// shipper call panics, and asserts that the worker recovers: the panic is
+// counted, every task in the batch receives an error, and the dequeued
+// batch is still released back to the queue.
+func TestWorker_RunOneSurvivesShipperPanic(t *testing.T) {
+	taskA := newTestTask(context.Background(), "tenant-a", "task-a")
+	taskB := newTestTask(context.Background(), "tenant-a", "task-b")
+	batch := []interface{}{taskA, taskB}
+
+	fq := &fakeWorkerQueue{batches: [][]interface{}{batch}}
+	registerer := prometheus.NewPedanticRegistry()
+	w := newWorker(
+		"w1",
+		workerConfig{maxWaitTime: time.Millisecond, maxItems: 10},
+		fq,
+		panickingShipper{},
+		noopTaskTracker{},
+		newTestPlanner(t),
+		NewTenantQueues(0, registerer, "loki", "bloomgateway"),
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		newWorkerMetrics(registerer, "loki", "bloomgateway"),
+	)
+
+	newIdx, err := w.runOne(context.Background(), queue.StartIndexWithLocalQueue)
+	if err != nil {
+		t.Fatalf("expected runOne to recover from the panic and report no error, got %v", err)
+	}
+	_ = newIdx
+
+	if got := testutil.ToFloat64(w.metrics.workerPanics.WithLabelValues("w1")); got != 1 {
+		t.Fatalf("expected worker_panics_total to be incremented once, got %v", got)
+	}
+
+	for _, task := range []Task{taskA, taskB} {
+		select {
+		case err := <-task.ErrCh:
+			if err == nil {
+				t.Fatalf("expected task %s to receive a non-nil error", task.ID)
+			}
+		default:
+			t.Fatalf("expected task %s to receive an error from the panic recovery", task.ID)
+		}
+	}
+
+	if len(fq.released) != 1 || len(fq.released[0]) != 2 {
+		t.Fatalf("expected the dequeued batch to be released back to the queue, got %v", fq.released)
+	}
+}
+
+// TestWorker_RunningSurvivesShipperPanic drives the worker's full running
+// loop through one panicking batch and confirms the loop keeps going
+// instead of dying, only stopping once its context is cancelled.
+func TestWorker_RunningSurvivesShipperPanic(t *testing.T) {
+	taskA := newTestTask(context.Background(), "tenant-a", "task-a")
+	batch := []interface{}{taskA}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fq := &fakeWorkerQueue{
+		batches:      [][]interface{}{batch},
+		afterDequeue: cancel,
+	}
+	registerer := prometheus.NewPedanticRegistry()
+	w := newWorker(
+		"w1",
+		workerConfig{maxWaitTime: time.Millisecond, maxItems: 10},
+		fq,
+		panickingShipper{},
+		noopTaskTracker{},
+		newTestPlanner(t),
+		NewTenantQueues(0, registerer, "loki", "bloomgateway"),
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		newWorkerMetrics(registerer, "loki", "bloomgateway"),
+	)
+
+	err := w.running(ctx)
+	if err == nil {
+		t.Fatal("expected running to return once its context was cancelled")
+	}
+
+	select {
+	case taskErr := <-taskA.ErrCh:
+		if taskErr == nil {
+			t.Fatal("expected the task to receive a non-nil error despite the panic")
+		}
+	default:
+		t.Fatal("expected the task to receive an error from the panic recovery before the loop exited")
+	}
+
+	if got := testutil.ToFloat64(w.metrics.workerPanics.WithLabelValues("w1")); got != 1 {
+		t.Fatalf("expected worker_panics_total to be incremented once, got %v", got)
+	}
+}